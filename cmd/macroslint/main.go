@@ -0,0 +1,63 @@
+// Command macroslint backs `mark macros lint`: it parses every macro
+// directive in the given files and reports problems -- a capture group
+// referenced that the regexp doesn't have, a template field the config can
+// never populate, a named capture group no rule selector looks at, a
+// dangling Attachment reference -- without rendering a single page.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/kovetskiy/mark/attachment"
+	"github.com/kovetskiy/mark/macro"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: mark macros lint <file.md>...")
+		os.Exit(2)
+	}
+
+	var ok = true
+
+	for _, path := range os.Args[1:] {
+		if !lintFile(path) {
+			ok = false
+		}
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// lintFile lints a single document and prints any problems to stderr. It
+// returns false if the document failed to lint cleanly.
+func lintFile(path string) bool {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return false
+	}
+
+	base := filepath.Dir(path)
+
+	// The CLI lints a document in isolation and passes an empty attachment
+	// list, so every `Attachment:` reference in a macro config is reported as
+	// not declared; the document's own attachment headers are not read.
+	lintErrs, err := macro.Lint(base, base, contents, template.New(path), []attachment.Attachment{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return false
+	}
+
+	for _, lintErr := range lintErrs {
+		lintErr.File = path
+		fmt.Fprintln(os.Stderr, lintErr.Error())
+	}
+
+	return len(lintErrs) == 0
+}
@@ -0,0 +1,233 @@
+package macro
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kovetskiy/mark/attachment"
+)
+
+var (
+	funcsMu sync.Mutex
+	funcs   = template.FuncMap{}
+
+	baseURLMu sync.RWMutex
+	baseURL   string
+)
+
+// RegisterFunc adds fn to the function map applied to every macro template,
+// making it callable from macro templates as {{ name ... }}. Call it from
+// main.go, before running the converter, to add project-specific helpers
+// alongside the built-ins below -- this is the stable entry point for
+// downstream users who want to template Confluence XHTML without a custom
+// Go build of mark itself.
+func RegisterFunc(name string, fn interface{}) {
+	funcsMu.Lock()
+	defer funcsMu.Unlock()
+
+	funcs[name] = fn
+}
+
+// Funcs returns a copy of the function map currently registered for macro
+// templates, suitable for passing to (*text/template.Template).Funcs.
+func Funcs() template.FuncMap {
+	funcsMu.Lock()
+	defer funcsMu.Unlock()
+
+	out := make(template.FuncMap, len(funcs))
+	for name, fn := range funcs {
+		out[name] = fn
+	}
+
+	return out
+}
+
+// SetBaseURL configures the base URL that the relURL template func resolves
+// paths against.
+func SetBaseURL(url string) {
+	baseURLMu.Lock()
+	defer baseURLMu.Unlock()
+
+	baseURL = url
+}
+
+func init() {
+	RegisterFunc("b64enc", func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	})
+
+	RegisterFunc("b64dec", func(s string) (string, error) {
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", err
+		}
+
+		return string(data), nil
+	})
+
+	RegisterFunc("sha1", func(s string) string {
+		sum := sha1.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	})
+
+	RegisterFunc("urlquery", url.QueryEscape)
+
+	RegisterFunc("htmlEscape", html.EscapeString)
+
+	RegisterFunc("xmlEscape", xmlEscapeString)
+
+	RegisterFunc("trimPrefix", func(prefix, s string) string {
+		return strings.TrimPrefix(s, prefix)
+	})
+
+	RegisterFunc("trimSuffix", func(suffix, s string) string {
+		return strings.TrimSuffix(s, suffix)
+	})
+
+	RegisterFunc("replace", func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	})
+
+	RegisterFunc("regexReplace", func(expr, repl, s string) (string, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return "", err
+		}
+
+		return re.ReplaceAllString(s, repl), nil
+	})
+
+	RegisterFunc("default", func(def interface{}, value interface{}) interface{} {
+		if isEmptyValue(value) {
+			return def
+		}
+
+		return value
+	})
+
+	RegisterFunc("dict", dictFunc)
+	RegisterFunc("list", listFunc)
+	RegisterFunc("toYaml", toYamlFunc)
+	RegisterFunc("fromYaml", fromYamlFunc)
+	RegisterFunc("lookupAttachment", lookupAttachmentFunc)
+	RegisterFunc("relURL", relURLFunc)
+}
+
+// xmlEscapeString escapes the characters that are not valid inside XML/XHTML
+// text content, as used by Confluence storage-format macros.
+func xmlEscapeString(s string) string {
+	replacer := strings.NewReplacer(
+		`&`, "&amp;",
+		`<`, "&lt;",
+		`>`, "&gt;",
+		`"`, "&quot;",
+		`'`, "&apos;",
+	)
+
+	return replacer.Replace(s)
+}
+
+func isEmptyValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	default:
+		return false
+	}
+}
+
+func dictFunc(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("dict: expected an even number of arguments, got %d", len(pairs))
+	}
+
+	dict := make(map[string]interface{}, len(pairs)/2)
+
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict: keys must be strings, got %T", pairs[i])
+		}
+
+		dict[key] = pairs[i+1]
+	}
+
+	return dict, nil
+}
+
+func listFunc(items ...interface{}) []interface{} {
+	return items
+}
+
+func toYamlFunc(value interface{}) (string, error) {
+	out, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func fromYamlFunc(s string) (interface{}, error) {
+	var value interface{}
+
+	err := yaml.Unmarshal([]byte(s), &value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// lookupAttachmentFunc is the lookupAttachment func bound by default, before
+// any document has been converted. It is only there so that macro templates
+// using {{ lookupAttachment ... }} resolve at Parse time; Macro.Apply rebinds
+// lookupAttachment to bindLookupAttachment(attachments) on the macro's
+// template group before executing any template, so templates run through
+// Apply never reach this default.
+func lookupAttachmentFunc(name string) (attachment.Attachment, error) {
+	return attachment.Attachment{}, fmt.Errorf("lookupAttachment: no attachments available")
+}
+
+// bindLookupAttachment returns a lookupAttachment implementation scoped to
+// attachments, which Macro.Apply binds onto a macro's template group; the
+// binding stays on the group until it is replaced.
+func bindLookupAttachment(attachments []attachment.Attachment) func(string) (attachment.Attachment, error) {
+	return func(name string) (attachment.Attachment, error) {
+		for _, att := range attachments {
+			if att.Name == name || att.Filename == name {
+				return att, nil
+			}
+		}
+
+		return attachment.Attachment{}, fmt.Errorf("lookupAttachment: no attachment named %q", name)
+	}
+}
+
+func relURLFunc(path string) string {
+	baseURLMu.RLock()
+	base := baseURL
+	baseURLMu.RUnlock()
+
+	if base == "" {
+		return path
+	}
+
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
@@ -0,0 +1,158 @@
+package macro
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func execFunc(t *testing.T, body string, data interface{}) (string, error) {
+	t.Helper()
+
+	tmpl, err := template.New("test").Funcs(Funcs()).Parse(body)
+	if err != nil {
+		t.Fatalf("unable to parse template: %s", err)
+	}
+
+	var buffer bytes.Buffer
+
+	err = tmpl.Execute(&buffer, data)
+
+	return buffer.String(), err
+}
+
+func TestB64Dec(t *testing.T) {
+	out, err := execFunc(t, `{{ b64dec "aGVsbG8=" }}`, nil)
+	if err != nil {
+		t.Fatalf("b64dec of valid input returned an error: %s", err)
+	}
+
+	if out != "hello" {
+		t.Errorf("b64dec(\"aGVsbG8=\") = %q, want %q", out, "hello")
+	}
+
+	_, err = execFunc(t, `{{ b64dec "not valid base64!" }}`, nil)
+	if err == nil {
+		t.Fatalf("expected b64dec of invalid input to error")
+	}
+}
+
+func TestRegexReplace(t *testing.T) {
+	out, err := execFunc(t, `{{ regexReplace "[0-9]+" "#" "room 42" }}`, nil)
+	if err != nil {
+		t.Fatalf("regexReplace with a valid pattern returned an error: %s", err)
+	}
+
+	if out != "room #" {
+		t.Errorf("regexReplace(...) = %q, want %q", out, "room #")
+	}
+
+	_, err = execFunc(t, `{{ regexReplace "(" "#" "s" }}`, nil)
+	if err == nil {
+		t.Fatalf("expected regexReplace with an invalid pattern to error")
+	}
+}
+
+func TestDefault(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "empty string falls back", body: `{{ default "fallback" "" }}`, want: "fallback"},
+		{name: "non-empty string kept", body: `{{ default "fallback" "value" }}`, want: "value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := execFunc(t, tt.body, nil)
+			if err != nil {
+				t.Fatalf("default returned an error: %s", err)
+			}
+
+			if out != tt.want {
+				t.Errorf("%s = %q, want %q", tt.body, out, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsEmptyValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  bool
+	}{
+		{name: "nil", value: nil, want: true},
+		{name: "empty string", value: "", want: true},
+		{name: "non-empty string", value: "x", want: false},
+		{name: "empty slice", value: []interface{}{}, want: true},
+		{name: "non-empty slice", value: []interface{}{1}, want: false},
+		{name: "empty map", value: map[string]interface{}{}, want: true},
+		{name: "non-empty map", value: map[string]interface{}{"a": 1}, want: false},
+		{name: "zero int is not considered empty", value: 0, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := isEmptyValue(tt.value)
+			if got != tt.want {
+				t.Errorf("isEmptyValue(%#v) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDictFunc(t *testing.T) {
+	dict, err := dictFunc("a", 1, "b", 2)
+	if err != nil {
+		t.Fatalf("dictFunc() with matched pairs returned an error: %s", err)
+	}
+
+	if dict["a"] != 1 || dict["b"] != 2 {
+		t.Errorf("dictFunc(\"a\", 1, \"b\", 2) = %v", dict)
+	}
+
+	_, err = dictFunc("a", 1, "b")
+	if err == nil {
+		t.Fatalf("expected dictFunc() with an odd number of arguments to error")
+	}
+
+	_, err = dictFunc(1, "a")
+	if err == nil {
+		t.Fatalf("expected dictFunc() with a non-string key to error")
+	}
+}
+
+func TestRelURLFunc(t *testing.T) {
+	SetBaseURL("")
+	if got := relURLFunc("/a/b"); got != "/a/b" {
+		t.Errorf("relURLFunc(\"/a/b\") with no base URL = %q, want %q", got, "/a/b")
+	}
+
+	SetBaseURL("https://example.com/docs/")
+	defer SetBaseURL("")
+
+	got := relURLFunc("/a/b")
+	want := "https://example.com/docs/a/b"
+	if got != want {
+		t.Errorf("relURLFunc(\"/a/b\") = %q, want %q", got, want)
+	}
+
+	got = relURLFunc("a/b")
+	if got != want {
+		t.Errorf("relURLFunc(\"a/b\") = %q, want %q", got, want)
+	}
+}
+
+func TestLookupAttachmentFuncDefaultErrors(t *testing.T) {
+	_, err := lookupAttachmentFunc("diagram.png")
+	if err == nil {
+		t.Fatalf("expected the unbound default lookupAttachment to error")
+	}
+
+	if !strings.Contains(err.Error(), "no attachments available") {
+		t.Errorf("unexpected error message: %s", err)
+	}
+}
@@ -0,0 +1,253 @@
+package macro
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/regexputil-go"
+)
+
+// maxMacroCallDepth bounds recursive expansion when named macros call each
+// other (directly or transitively) through their templates, so a macro
+// library with a cycle fails loudly instead of hanging the converter.
+const maxMacroCallDepth = 64
+
+var reMacroImport = regexp.MustCompile(
+	`(?s)<!--\s*MacroImport:\s*(?P<path>[^\n]+?)\s*-->`,
+)
+
+var reDefineMacro = regexp.MustCompile(
+	`(?s)` +
+		/**/ `<!--\s*DefineMacro:\s*(?P<name>[a-zA-Z_][a-zA-Z0-9_]*)\((?P<args>[^)]*)\)\s*\n` +
+		/*   */ `(?P<body>.*?)-->`,
+)
+
+// NamedMacro is a macro registered under a name so that it can be called
+// from the templates of other macros, e.g. {{ warningIcon }} or
+// {{ panel "title" "body" }}, mirroring how pongo2 binds imported macros as
+// callable names in the execution context.
+type NamedMacro struct {
+	Name     string
+	Args     []string
+	Template *template.Template
+}
+
+// Registry holds the named macros available to a document: the ones it
+// defines itself via DefineMacro and the ones pulled in via MacroImport.
+type Registry struct {
+	Named map[string]*NamedMacro
+	depth int
+}
+
+func newRegistry() *Registry {
+	return &Registry{Named: map[string]*NamedMacro{}}
+}
+
+// bind turns every macro currently in the registry into a callable function
+// on templates, so that any macro template parsed afterwards can invoke its
+// peers by name. Calls are counted against a shared depth so that mutually
+// recursive macros fail with an error instead of recursing forever.
+func (registry *Registry) bind(templates *template.Template) {
+	funcs := template.FuncMap{}
+
+	for name, named := range registry.Named {
+		named := named
+
+		funcs[name] = func(args ...interface{}) (string, error) {
+			registry.depth++
+			defer func() { registry.depth-- }()
+
+			if registry.depth > maxMacroCallDepth {
+				return "", fmt.Errorf(
+					"macro %q: max call depth (%d) exceeded, likely a recursive macro",
+					name, maxMacroCallDepth,
+				)
+			}
+
+			data := map[string]interface{}{}
+			for i, arg := range named.Args {
+				if i < len(args) {
+					data[arg] = args[i]
+				}
+			}
+
+			var buffer bytes.Buffer
+
+			err := named.Template.Execute(&buffer, data)
+			if err != nil {
+				return "", karma.Format(err, "unable to execute macro %q", name)
+			}
+
+			return buffer.String(), nil
+		}
+	}
+
+	templates.Funcs(funcs)
+}
+
+// resolveImports expands `MacroImport:` directives, loading the referenced
+// library files relative to base and merging the named macros they define
+// into registry. Libraries are themselves allowed to import other
+// libraries.
+func resolveImports(
+	base string,
+	includePath string,
+	contents []byte,
+	templates *template.Template,
+	registry *Registry,
+) ([]byte, error) {
+	return resolveImportsVisited(base, includePath, contents, templates, registry, map[string]bool{})
+}
+
+// resolveImportsVisited is resolveImports with the set of library paths
+// already being resolved in the current import chain, so that a library
+// importing (directly or transitively) itself fails with a karma-formatted
+// error instead of recursing forever.
+func resolveImportsVisited(
+	base string,
+	includePath string,
+	contents []byte,
+	templates *template.Template,
+	registry *Registry,
+	visited map[string]bool,
+) ([]byte, error) {
+	var err error
+
+	contents = reMacroImport.ReplaceAllFunc(contents, func(spec []byte) []byte {
+		if err != nil {
+			return spec
+		}
+
+		groups := reMacroImport.FindStringSubmatch(string(spec))
+		path := regexputil.Subexp(reMacroImport, groups, "path")
+
+		facts := karma.Describe("path", path)
+
+		fullPath := filepath.Join(base, path)
+
+		absPath, absErr := filepath.Abs(fullPath)
+		if absErr != nil {
+			err = facts.Format(absErr, "unable to resolve macro library path")
+			return nil
+		}
+
+		if visited[absPath] {
+			err = facts.Format(
+				fmt.Errorf("import cycle detected"),
+				"unable to load macro library",
+			)
+			return nil
+		}
+
+		library, readErr := os.ReadFile(fullPath)
+		if readErr != nil {
+			err = facts.Format(readErr, "unable to read macro library")
+			return nil
+		}
+
+		childVisited := make(map[string]bool, len(visited)+1)
+		for p := range visited {
+			childVisited[p] = true
+		}
+		childVisited[absPath] = true
+
+		library, err = resolveImportsVisited(
+			filepath.Dir(fullPath),
+			includePath,
+			library,
+			templates,
+			registry,
+			childVisited,
+		)
+		if err != nil {
+			return nil
+		}
+
+		_, err = extractDefineMacros(library, templates, registry)
+		if err != nil {
+			err = facts.Format(err, "unable to load macro library")
+			return nil
+		}
+
+		return []byte{}
+	})
+
+	return contents, err
+}
+
+// extractDefineMacros parses `DefineMacro:` directives out of contents,
+// compiling each one's body as a template and registering it in registry
+// under its declared name.
+//
+// Registration happens in two passes so that named macros can call each
+// other regardless of declaration order, including self- and mutual
+// recursion: a placeholder NamedMacro is registered (and bound as a
+// callable function) for every name declared in contents before any body
+// is parsed, so a Go template Parse of one macro's body can already
+// resolve a peer declared later in the same file. Each body is then
+// parsed in a second pass and spliced into its placeholder's Template
+// field in place, so the closures bound in the first pass see the real
+// template once they're executed.
+func extractDefineMacros(
+	contents []byte,
+	templates *template.Template,
+	registry *Registry,
+) ([]byte, error) {
+	specs := reDefineMacro.FindAllStringSubmatch(string(contents), -1)
+
+	for _, groups := range specs {
+		name := regexputil.Subexp(reDefineMacro, groups, "name")
+		if _, ok := registry.Named[name]; ok {
+			continue
+		}
+
+		raw := regexputil.Subexp(reDefineMacro, groups, "args")
+
+		var args []string
+		for _, arg := range strings.Split(raw, ",") {
+			arg = strings.TrimSpace(arg)
+			if arg != "" {
+				args = append(args, arg)
+			}
+		}
+
+		registry.Named[name] = &NamedMacro{Name: name, Args: args}
+	}
+
+	registry.bind(templates)
+
+	var err error
+
+	contents = reDefineMacro.ReplaceAllFunc(contents, func(spec []byte) []byte {
+		if err != nil {
+			return spec
+		}
+
+		groups := reDefineMacro.FindStringSubmatch(string(spec))
+
+		var (
+			name = regexputil.Subexp(reDefineMacro, groups, "name")
+			body = regexputil.Subexp(reDefineMacro, groups, "body")
+		)
+
+		tmpl, parseErr := templates.New("macro:" + name).Parse(body)
+		if parseErr != nil {
+			err = karma.Describe("name", name).
+				Format(parseErr, "unable to parse defined macro template")
+
+			return nil
+		}
+
+		registry.Named[name].Template = tmpl
+
+		return []byte{}
+	})
+
+	return contents, err
+}
@@ -0,0 +1,142 @@
+package macro
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestExtractDefineMacrosForwardReference(t *testing.T) {
+	contents := []byte(
+		"<!-- DefineMacro: first()\n" +
+			"{{ second }}-->\n" +
+			"\n" +
+			"<!-- DefineMacro: second()\n" +
+			"hello-->\n",
+	)
+
+	registry := newRegistry()
+	templates := template.New("root")
+
+	_, err := extractDefineMacros(contents, templates, registry)
+	if err != nil {
+		t.Fatalf("extractDefineMacros() returned an error: %s", err)
+	}
+
+	first, ok := registry.Named["first"]
+	if !ok {
+		t.Fatalf("expected \"first\" to be registered")
+	}
+
+	var buffer strings.Builder
+
+	err = first.Template.Execute(&buffer, nil)
+	if err != nil {
+		t.Fatalf("first.Template.Execute() returned an error: %s", err)
+	}
+
+	if buffer.String() != "hello" {
+		t.Errorf("first.Template.Execute() = %q, want %q", buffer.String(), "hello")
+	}
+}
+
+func TestExtractDefineMacrosMutualRecursionHitsMaxDepth(t *testing.T) {
+	contents := []byte(
+		"<!-- DefineMacro: a()\n" +
+			"{{ b }}-->\n" +
+			"\n" +
+			"<!-- DefineMacro: b()\n" +
+			"{{ a }}-->\n",
+	)
+
+	registry := newRegistry()
+	templates := template.New("root")
+
+	_, err := extractDefineMacros(contents, templates, registry)
+	if err != nil {
+		t.Fatalf("extractDefineMacros() returned an error: %s", err)
+	}
+
+	var buffer strings.Builder
+
+	err = registry.Named["a"].Template.Execute(&buffer, nil)
+	if err == nil {
+		t.Fatalf("expected Execute() of mutually recursive macros to fail, got nil error")
+	}
+
+	if !strings.Contains(err.Error(), "max call depth") {
+		t.Errorf("expected error to mention the max call depth guard, got: %s", err)
+	}
+}
+
+func TestResolveImportsMakesImportedMacroCallable(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(dir, "lib.md"), []byte(
+		"<!-- DefineMacro: greet()\n"+
+			"hi there-->\n",
+	), 0o644)
+	if err != nil {
+		t.Fatalf("unable to write library fixture: %s", err)
+	}
+
+	contents := []byte("<!-- MacroImport: lib.md -->\n")
+
+	registry := newRegistry()
+	templates := template.New("root")
+
+	_, err = resolveImports(dir, dir, contents, templates, registry)
+	if err != nil {
+		t.Fatalf("resolveImports() returned an error: %s", err)
+	}
+
+	greet, ok := registry.Named["greet"]
+	if !ok {
+		t.Fatalf("expected \"greet\" to be registered after MacroImport")
+	}
+
+	var buffer strings.Builder
+
+	err = greet.Template.Execute(&buffer, nil)
+	if err != nil {
+		t.Fatalf("greet.Template.Execute() returned an error: %s", err)
+	}
+
+	if buffer.String() != "hi there" {
+		t.Errorf("greet.Template.Execute() = %q, want %q", buffer.String(), "hi there")
+	}
+}
+
+func TestResolveImportsDetectsCycle(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(dir, "a.md"), []byte(
+		"<!-- MacroImport: b.md -->\n",
+	), 0o644)
+	if err != nil {
+		t.Fatalf("unable to write fixture a.md: %s", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "b.md"), []byte(
+		"<!-- MacroImport: a.md -->\n",
+	), 0o644)
+	if err != nil {
+		t.Fatalf("unable to write fixture b.md: %s", err)
+	}
+
+	registry := newRegistry()
+	templates := template.New("root")
+
+	contents := []byte("<!-- MacroImport: a.md -->\n")
+
+	_, err = resolveImports(dir, dir, contents, templates, registry)
+	if err == nil {
+		t.Fatalf("expected resolveImports() to fail on an import cycle, got nil error")
+	}
+
+	if !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected error to mention the import cycle, got: %s", err)
+	}
+}
@@ -0,0 +1,288 @@
+package macro
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kovetskiy/mark/attachment"
+	"github.com/kovetskiy/mark/macro/parsers"
+)
+
+// reConfigGroupRef finds ${N} positional references in a macro's raw config
+// string, the same syntax macro.configure substitutes.
+var reConfigGroupRef = regexp.MustCompile(`\$\{(\d+)\}`)
+
+// LintError is a single problem found by Validate or Lint, with enough
+// location information to point the author at the offending directive.
+type LintError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e LintError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Err)
+	}
+
+	return e.Err.Error()
+}
+
+// Validate checks a loaded Macro for the mistakes that are easy to make but
+// hard to notice until render time: a config referencing a capture group
+// the regexp doesn't have, a template field that the config will never
+// populate, a named capture group that no rule's selector ever looks at,
+// and an Attachment reference that doesn't match any attachment declared in
+// the document. It does not execute any template.
+func (macro *Macro) Validate(attachments []attachment.Attachment) []error {
+	var errs []error
+
+	config := map[string]interface{}{}
+
+	err := yaml.Unmarshal([]byte(macro.Config), &config)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("config does not parse as YAML: %w", err))
+
+		// The remaining checks all need a parsed config; nothing further to
+		// check without one.
+		return errs
+	}
+
+	errs = append(errs, macro.validateGroupRefs()...)
+	errs = append(errs, macro.validateUnreferencedGroups()...)
+	errs = append(errs, macro.validateTemplateFields(config)...)
+	errs = append(errs, macro.validateAttachmentRefs(config, attachments)...)
+
+	return errs
+}
+
+// validateGroupRefs checks that every ${N} in Config has a matching capture
+// group in Regexp.
+func (macro *Macro) validateGroupRefs() []error {
+	var errs []error
+
+	groupCount := macro.Regexp.NumSubexp()
+
+	for _, match := range reConfigGroupRef.FindAllStringSubmatch(macro.Config, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+
+		if n > groupCount {
+			errs = append(errs, fmt.Errorf(
+				"config references ${%d} but the regexp only has %d capture group(s)",
+				n, groupCount,
+			))
+		}
+	}
+
+	return errs
+}
+
+// validateUnreferencedGroups checks that every named capture group in
+// Regexp is referenced by at least one rule's `when` selector -- the only
+// thing named groups feed today.
+func (macro *Macro) validateUnreferencedGroups() []error {
+	var errs []error
+
+	referenced := map[string]bool{}
+
+	for _, rule := range macro.Rules {
+		for key := range rule.When {
+			referenced[key] = true
+		}
+	}
+
+	for _, name := range macro.Regexp.SubexpNames() {
+		if name == "" {
+			continue
+		}
+
+		if !referenced[name] {
+			errs = append(errs, fmt.Errorf(
+				"named capture group %q is never referenced by a rule selector",
+				name,
+			))
+		}
+	}
+
+	return errs
+}
+
+// validateTemplateFields checks that every top-level `.Field` a rule's
+// template accesses resolves to a key present in config.
+func (macro *Macro) validateTemplateFields(config map[string]interface{}) []error {
+	var errs []error
+
+	keys := map[string]bool{}
+	for key := range config {
+		keys[fmt.Sprint(key)] = true
+	}
+
+	for _, rule := range macro.Rules {
+		if rule.Template == nil || rule.Template.Tree == nil {
+			continue
+		}
+
+		for _, field := range unresolvedFields(rule.Template.Tree.Root, keys) {
+			errs = append(errs, fmt.Errorf(
+				"template %q references .%s, which is not a key in config",
+				rule.Template.Name(), field,
+			))
+		}
+	}
+
+	return errs
+}
+
+// validateAttachmentRefs checks that an `Attachment:` reference in config
+// matches a declared attachment.
+func (macro *Macro) validateAttachmentRefs(config map[string]interface{}, attachments []attachment.Attachment) []error {
+	ref, ok := config["Attachment"].(string)
+	if !ok || ref == "" {
+		return nil
+	}
+
+	for _, att := range attachments {
+		if att.Name == ref || att.Filename == ref {
+			return nil
+		}
+	}
+
+	return []error{fmt.Errorf(
+		"config references Attachment %q, which is not declared in the document",
+		ref,
+	)}
+}
+
+// unresolvedFields walks a template's parse tree looking for top-level
+// field accesses (".Foo") whose name is not in keys. keys is nil inside a
+// scope where "." no longer refers to config -- the body of a {{ with }} or
+// {{ range }} rebinds it to the matched/iterated value, which Validate has
+// no static knowledge of, so field accesses there are left unchecked rather
+// than reported as false positives.
+func unresolvedFields(node parse.Node, keys map[string]bool) []string {
+	if keys == nil {
+		return nil
+	}
+
+	var unresolved []string
+
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+
+		for _, n := range node.Nodes {
+			unresolved = append(unresolved, unresolvedFields(n, keys)...)
+		}
+	case *parse.ActionNode:
+		unresolved = append(unresolved, unresolvedFieldsInPipe(node.Pipe, keys)...)
+	case *parse.IfNode:
+		// {{ if }} does not rebind ".", so both branches keep the outer scope.
+		unresolved = append(unresolved, unresolvedFieldsInPipe(node.Pipe, keys)...)
+		unresolved = append(unresolved, unresolvedFields(node.List, keys)...)
+		unresolved = append(unresolved, unresolvedFields(node.ElseList, keys)...)
+	case *parse.WithNode:
+		// {{ with }} rebinds "." to the piped value inside List; ElseList
+		// only runs when that value is falsy, so it keeps the outer scope.
+		unresolved = append(unresolved, unresolvedFieldsInPipe(node.Pipe, keys)...)
+		unresolved = append(unresolved, unresolvedFields(node.List, nil)...)
+		unresolved = append(unresolved, unresolvedFields(node.ElseList, keys)...)
+	case *parse.RangeNode:
+		// {{ range }} rebinds "." to each item inside List; ElseList only
+		// runs when the range is empty, so it keeps the outer scope.
+		unresolved = append(unresolved, unresolvedFieldsInPipe(node.Pipe, keys)...)
+		unresolved = append(unresolved, unresolvedFields(node.List, nil)...)
+		unresolved = append(unresolved, unresolvedFields(node.ElseList, keys)...)
+	}
+
+	return unresolved
+}
+
+func unresolvedFieldsInPipe(pipe *parse.PipeNode, keys map[string]bool) []string {
+	if pipe == nil {
+		return nil
+	}
+
+	var unresolved []string
+
+	for _, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			field, ok := arg.(*parse.FieldNode)
+			if !ok || len(field.Ident) == 0 {
+				continue
+			}
+
+			if !keys[field.Ident[0]] {
+				unresolved = append(unresolved, field.Ident[0])
+			}
+		}
+	}
+
+	return unresolved
+}
+
+// Lint loads every macro directive in contents through the same pipeline
+// ExtractMacros uses for a real render, then runs Validate over each one.
+// This backs the `mark macros lint` subcommand, which reports problems in a
+// macro library without rendering a single page, catching mistakes that
+// would otherwise only surface the next time the directive's regexp
+// happens to match something.
+func Lint(
+	base string,
+	includePath string,
+	contents []byte,
+	templates *template.Template,
+	attachments []attachment.Attachment,
+) ([]LintError, error) {
+	text := string(contents)
+
+	lines := make([]int, 0)
+	for _, idx := range parsers.Directive.FindAllIndex(contents, -1) {
+		lines = append(lines, 1+strings.Count(text[:idx[0]], "\n"))
+	}
+
+	// ExtractMacros stops loading macros at the first directive it can't
+	// parse/compile/load, but still returns every macro it loaded
+	// successfully before that point. Lint reports diagnostics for those,
+	// plus the load error itself pinned to the directive that caused it,
+	// rather than discarding everything after -- a lint mode that goes
+	// silent past the first bad directive in a file defeats its own point.
+	macros, _, _, loadErr := ExtractMacros(base, includePath, contents, templates)
+
+	var lintErrs []LintError
+
+	for i, macro := range macros {
+		var line int
+		if i < len(lines) {
+			line = lines[i]
+		}
+
+		for _, verr := range macro.Validate(attachments) {
+			lintErrs = append(lintErrs, LintError{Line: line, Err: verr})
+		}
+	}
+
+	if loadErr != nil {
+		var line int
+		if len(macros) < len(lines) {
+			line = lines[len(macros)]
+		}
+
+		lintErrs = append(lintErrs, LintError{
+			Line: line,
+			Err:  fmt.Errorf("unable to load macro: %w", loadErr),
+		})
+	}
+
+	return lintErrs, nil
+}
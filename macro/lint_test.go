@@ -0,0 +1,164 @@
+package macro
+
+import (
+	"regexp"
+	"testing"
+	"text/template"
+
+	"github.com/kovetskiy/mark/attachment"
+)
+
+func parseBody(t *testing.T, body string) *template.Template {
+	t.Helper()
+
+	tmpl, err := template.New("test").Parse(body)
+	if err != nil {
+		t.Fatalf("unable to parse template: %s", err)
+	}
+
+	return tmpl
+}
+
+func TestUnresolvedFields(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		keys map[string]bool
+		want []string
+	}{
+		{
+			name: "known top-level field resolves",
+			body: `{{ .Title }}`,
+			keys: map[string]bool{"Title": true},
+			want: nil,
+		},
+		{
+			name: "unknown top-level field is reported",
+			body: `{{ .Bogus }}`,
+			keys: map[string]bool{"Title": true},
+			want: []string{"Bogus"},
+		},
+		{
+			name: "if does not rebind dot",
+			body: `{{ if .Title }}{{ .Title }}{{ else }}{{ .Title }}{{ end }}`,
+			keys: map[string]bool{"Title": true},
+			want: nil,
+		},
+		{
+			name: "range body is not checked against outer keys",
+			body: `{{ range .Items }}{{ .Name }}{{ end }}`,
+			keys: map[string]bool{"Items": true},
+			want: nil,
+		},
+		{
+			name: "with body is not checked against outer keys",
+			body: `{{ with .Sub }}{{ .X }}{{ end }}`,
+			keys: map[string]bool{"Sub": true},
+			want: nil,
+		},
+		{
+			name: "range else keeps outer scope",
+			body: `{{ range .Items }}{{ .Name }}{{ else }}{{ .Bogus }}{{ end }}`,
+			keys: map[string]bool{"Items": true},
+			want: []string{"Bogus"},
+		},
+		{
+			name: "with pipe argument still checked against outer keys",
+			body: `{{ with .Bogus }}{{ .X }}{{ end }}`,
+			keys: map[string]bool{"Sub": true},
+			want: []string{"Bogus"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := parseBody(t, tt.body)
+
+			got := unresolvedFields(tmpl.Tree.Root, tt.keys)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("unresolvedFields() = %v, want %v", got, tt.want)
+			}
+
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("unresolvedFields() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateGroupRefs(t *testing.T) {
+	macro := &Macro{
+		Regexp: regexp.MustCompile(`(\w+)`),
+		Config: `Title: ${2}`,
+	}
+
+	errs := macro.validateGroupRefs()
+	if len(errs) != 1 {
+		t.Fatalf("expected one error for out-of-range ${2}, got %v", errs)
+	}
+}
+
+func TestValidateUnreferencedGroups(t *testing.T) {
+	macro := &Macro{
+		Regexp: regexp.MustCompile(`(?P<lang>\w+):(?P<body>.*)`),
+		Rules:  []Rule{{When: map[string]interface{}{"lang": "go"}}},
+	}
+
+	errs := macro.validateUnreferencedGroups()
+	if len(errs) != 1 {
+		t.Fatalf("expected one error for unreferenced group %q, got %v", "body", errs)
+	}
+}
+
+// TestLintReportsDiagnosticsPastAFailedDirective ensures a macro directive
+// that fails to load doesn't swallow diagnostics for directives that loaded
+// fine before it.
+func TestLintReportsDiagnosticsPastAFailedDirective(t *testing.T) {
+	contents := []byte("" +
+		"<!-- Macro: \\w+\n" +
+		"     Template: #body\n" +
+		"body: '{{ .Bogus }}'\n" +
+		"-->\n" +
+		"\n" +
+		"<!-- Macro: (\n" +
+		"     Template: other.tmpl -->\n")
+
+	lintErrs, err := Lint("", "", contents, template.New("test"), nil)
+	if err != nil {
+		t.Fatalf("Lint() returned an error: %s", err)
+	}
+
+	if len(lintErrs) != 2 {
+		t.Fatalf("expected 2 lint errors (one from the first macro's field check, "+
+			"one reporting the second macro's load failure), got %d: %v", len(lintErrs), lintErrs)
+	}
+
+	if lintErrs[0].Line != 1 {
+		t.Errorf("expected the first macro's diagnostic on line 1, got line %d", lintErrs[0].Line)
+	}
+
+	if lintErrs[1].Line != 6 {
+		t.Errorf("expected the second macro's load-failure diagnostic on line 6, got line %d", lintErrs[1].Line)
+	}
+}
+
+func TestValidateAttachmentRefs(t *testing.T) {
+	macro := &Macro{}
+
+	attachments := []attachment.Attachment{{Name: "diagram.png"}}
+
+	if errs := macro.validateAttachmentRefs(
+		map[string]interface{}{"Attachment": "diagram.png"}, attachments,
+	); len(errs) != 0 {
+		t.Fatalf("expected no errors for a declared attachment, got %v", errs)
+	}
+
+	if errs := macro.validateAttachmentRefs(
+		map[string]interface{}{"Attachment": "missing.png"}, attachments,
+	); len(errs) != 1 {
+		t.Fatalf("expected one error for an undeclared attachment, got %v", errs)
+	}
+}
@@ -9,36 +9,45 @@ import (
 
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
-	"github.com/reconquest/regexputil-go"
 	"gopkg.in/yaml.v3"
 
 	"github.com/kovetskiy/mark/attachment"
-	"github.com/kovetskiy/mark/includes"
+	"github.com/kovetskiy/mark/macro/parsers"
 )
 
-var reMacroDirective = regexp.MustCompile(
-	// <!-- Macro: <regexp>
-	//      Template: <template path>
-	//      <optional yaml data> -->
-
-	`(?s)` + // dot capture newlines
-		/**/ `<!--\s*Macro:\s*(?P<expr>[^\n]+)\n` +
-		/*    */ `\s*Template:\s*(?P<template>.+?)\s*` +
-		/*   */ `(?P<config>\n.*?)?-->`,
-)
+// reMacroDirective is kept as an alias of parsers.Directive so existing
+// callers that matched on it keep working unchanged.
+var reMacroDirective = parsers.Directive
 
 type Macro struct {
 	Regexp   *regexp.Regexp
 	Template *template.Template
 	Config   string
+
+	// Rules holds the macro's template alternatives. A macro declared with
+	// the classic `Template: <path>` form has exactly one, always-matching
+	// rule here; `Template: rules` macros have one per `rules:` entry.
+	Rules []Rule
 }
 
 func (macro *Macro) Apply(
 	content []byte,
 	attachments []attachment.Attachment,
+	vars map[string]string,
 ) ([]byte, error) {
 	var err error
 
+	env := buildEnv(vars)
+
+	// Bind lookupAttachment to this call's attachments on the shared
+	// template group (all Rules' templates descend from the same group, so
+	// this reaches every rule). The binding stays on the group after Apply
+	// returns until the next Apply replaces it, so concurrent Apply calls on
+	// macros sharing a group use whichever binding was set last.
+	macro.Template.Funcs(template.FuncMap{
+		"lookupAttachment": bindLookupAttachment(attachments),
+	})
+
 	content = macro.Regexp.ReplaceAllFunc(
 		content,
 		func(match []byte) []byte {
@@ -52,18 +61,24 @@ func (macro *Macro) Apply(
 				)
 			}
 
+			groups := macro.Regexp.FindSubmatch(match)
+			tags := buildTags(macro.Regexp, groups, vars)
+			data := macro.configure(config, groups, attachments, env)
+
 			var buffer bytes.Buffer
 
-			err = macro.Template.Execute(&buffer, macro.configure(
-				config,
-				macro.Regexp.FindSubmatch(match),
-				attachments,
-			))
-			if err != nil {
-				err = karma.Format(
-					err,
-					"unable to execute macros template",
-				)
+			for _, rule := range macro.Rules {
+				if !selectorMatches(rule.When, tags) {
+					continue
+				}
+
+				execErr := rule.Template.Execute(&buffer, data)
+				if execErr != nil {
+					err = karma.Format(
+						execErr,
+						"unable to execute macros template",
+					)
+				}
 			}
 
 			return buffer.Bytes()
@@ -73,17 +88,17 @@ func (macro *Macro) Apply(
 	return content, err
 }
 
-func (macro *Macro) configure(node interface{}, groups [][]byte, attachments []attachment.Attachment) interface{} {
+func (macro *Macro) configure(node interface{}, groups [][]byte, attachments []attachment.Attachment, env map[string]string) interface{} {
 	switch node := node.(type) {
 	case map[interface{}]interface{}:
 		for key, value := range node {
-			node[key] = macro.configure(value, groups, attachments)
+			node[key] = macro.configure(value, groups, attachments, env)
 		}
 
 		return node
 	case map[string]interface{}:
 		for key, value := range node {
-			node[key] = macro.configure(value, groups, attachments)
+			node[key] = macro.configure(value, groups, attachments, env)
 		}
 
 		// Special handling for ac:image template - auto-populate width/height from attachment
@@ -92,11 +107,18 @@ func (macro *Macro) configure(node interface{}, groups [][]byte, attachments []a
 		return node
 	case []interface{}:
 		for key, value := range node {
-			node[key] = macro.configure(value, groups, attachments)
+			node[key] = macro.configure(value, groups, attachments, env)
 		}
 
 		return node
 	case string:
+		// Bash-style ${VAR}, ${VAR:-default}, etc. are resolved first, while
+		// node is still exactly the macro author's declared config string.
+		// Only afterwards do we splice in ${N} capture groups, which may
+		// contain arbitrary document text (e.g. a captured code block) that
+		// must not be re-scanned for variable references.
+		node = interpolateVars(node, env)
+
 		for i, group := range groups {
 			node = strings.ReplaceAll(
 				node,
@@ -116,94 +138,107 @@ func ExtractMacros(
 	includePath string,
 	contents []byte,
 	templates *template.Template,
-) ([]Macro, []byte, error) {
+) ([]Macro, map[string]*NamedMacro, []byte, error) {
 	var err error
 
+	templates.Funcs(Funcs())
+
+	registry := newRegistry()
+
+	contents, err = resolveImports(base, includePath, contents, templates, registry)
+	if err != nil {
+		return nil, nil, contents, err
+	}
+
+	contents, err = extractDefineMacros(contents, templates, registry)
+	if err != nil {
+		return nil, nil, contents, err
+	}
+
+	registry.bind(templates)
+
 	var macros []Macro
 
 	contents = reMacroDirective.ReplaceAllFunc(
 		contents,
-		func(spec []byte) []byte {
+		func(raw []byte) []byte {
 			if err != nil {
-				return spec
+				return raw
 			}
 
-			groups := reMacroDirective.FindStringSubmatch(string(spec))
+			spec, parseErr := parsers.ParseDirective(raw)
+			if parseErr != nil {
+				err = parseErr
+				return nil
+			}
 
-			var (
-				expr     = regexputil.Subexp(reMacroDirective, groups, "expr")
-				template = regexputil.Subexp(
-					reMacroDirective,
-					groups,
-					"template",
-				)
-				config = regexputil.Subexp(reMacroDirective, groups, "config")
-			)
+			facts := karma.
+				Describe("template", spec.Template).
+				Describe("expr", spec.Expr)
 
 			var macro Macro
 
-			if strings.HasPrefix(template, "#") {
-				cfg := map[string]interface{}{}
+			if spec.Template == "rules" {
+				macro.Regexp, err = regexp.Compile(spec.Expr)
+				if err != nil {
+					err = facts.Format(err, "unable to compile macros regexp")
+					return nil
+				}
+
+				macro.Config = spec.Config
+
+				var rulesCfg rulesSpec
 
-				err = yaml.Unmarshal([]byte(config), &cfg)
+				err = yaml.Unmarshal([]byte(spec.Config), &rulesCfg)
 				if err != nil {
 					err = karma.Format(
 						err,
-						"unable to unmarshal macros config template",
+						"unable to unmarshal macro rules config",
 					)
 
 					return nil
 				}
 
-				body, ok := cfg[template[1:]].(string)
-				if !ok {
+				if len(rulesCfg.Rules) == 0 {
 					err = fmt.Errorf(
-						"the template config doesn't have '%s' field",
-						template[1:],
+						"macro declares 'Template: rules' but its config has no 'rules:' entries",
 					)
 
 					return nil
 				}
 
-				macro.Template, err = templates.New(template).Parse(body)
-				if err != nil {
-					err = karma.Format(
-						err,
-						"unable to parse template",
-					)
+				for _, rule := range rulesCfg.Rules {
+					var tmpl *template.Template
 
-					return nil
+					tmpl, err = parsers.LoadTemplateRef(rule.Template, spec.Config, base, includePath, templates)
+					if err != nil {
+						err = facts.Format(err, "unable to load rule template")
+						return nil
+					}
+
+					macro.Rules = append(macro.Rules, Rule{When: rule.When, Template: tmpl})
 				}
+
+				macro.Template = macro.Rules[0].Template
 			} else {
-				macro.Template, err = includes.LoadTemplate(base, includePath, template, "{{", "}}", templates)
-				if err != nil {
-					err = karma.Format(err, "unable to load template")
+				var loaded parsers.Macro
 
+				loaded, err = parsers.LoadMacro(spec, base, includePath, templates)
+				if err != nil {
+					err = facts.Format(err, "unable to load macro")
 					return nil
 				}
-			}
-
-			facts := karma.
-				Describe("template", template).
-				Describe("expr", expr)
 
-			macro.Regexp, err = regexp.Compile(expr)
-			if err != nil {
-				err = facts.
-					Format(
-						err,
-						"unable to compile macros regexp",
-					)
-
-				return nil
+				macro.Regexp = loaded.Regexp
+				macro.Template = loaded.Template
+				macro.Config = loaded.Config
+				macro.Rules = []Rule{{Template: macro.Template}}
 			}
 
-			macro.Config = config
-
 			log.Tracef(
 				facts.Describe("config", macro.Config),
 				"loaded macro %q",
-				expr,
+				spec.Expr,
 			)
 
 			macros = append(macros, macro)
@@ -212,7 +247,7 @@ func ExtractMacros(
 		},
 	)
 
-	return macros, contents, err
+	return macros, registry.Named, contents, err
 }
 
 // populateAttachmentDimensions auto-populates Width and Height from attachment metadata
@@ -0,0 +1,142 @@
+// Package parsers implements the low-level parsing that the macro package
+// builds on: turning the raw bytes of a `<!-- Macro: ... -->` directive into
+// a Spec, and turning a Spec into a compiled regexp plus a loaded template.
+// It is split out of macro so that tools which only need to look at macro
+// directives -- such as a lint mode -- can do so without pulling in the
+// rest of the converter (analogous to how Nuclei split template loading out
+// of its runner).
+package parsers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/regexputil-go"
+	"gopkg.in/yaml.v3"
+
+	"github.com/kovetskiy/mark/includes"
+)
+
+// Directive matches a single macro directive comment:
+//
+//	<!-- Macro: <regexp>
+//	     Template: <template path>
+//	     <optional yaml data> -->
+var Directive = regexp.MustCompile(
+	`(?s)` + // dot capture newlines
+		/**/ `<!--\s*Macro:\s*(?P<expr>[^\n]+)\n` +
+		/*    */ `\s*Template:\s*(?P<template>.+?)\s*` +
+		/*   */ `(?P<config>\n.*?)?-->`,
+)
+
+// Spec is the raw, unparsed form of a macro directive's fields.
+type Spec struct {
+	Expr     string
+	Template string
+	Config   string
+}
+
+// ParseDirective parses the raw bytes of a single macro directive, as
+// matched by Directive, into a Spec.
+func ParseDirective(raw []byte) (Spec, error) {
+	groups := Directive.FindStringSubmatch(string(raw))
+	if groups == nil {
+		return Spec{}, fmt.Errorf("not a macro directive: %q", raw)
+	}
+
+	return Spec{
+		Expr:     regexputil.Subexp(Directive, groups, "expr"),
+		Template: regexputil.Subexp(Directive, groups, "template"),
+		Config:   regexputil.Subexp(Directive, groups, "config"),
+	}, nil
+}
+
+// Macro is a compiled macro directive: its trigger regexp and the template
+// it expands into. It has no notion of rules, named-macro composition or
+// config interpolation layers -- those belong to the macro package, which
+// wraps Macro into its own richer type.
+type Macro struct {
+	Regexp   *regexp.Regexp
+	Template *template.Template
+	Config   string
+}
+
+// LoadMacro compiles spec's regexp and loads its template, either from a
+// file via includes.LoadTemplate, or, if Template starts with "#", from a
+// named field embedded in spec's own YAML config.
+func LoadMacro(
+	spec Spec,
+	base string,
+	includePath string,
+	templates *template.Template,
+) (Macro, error) {
+	var macro Macro
+
+	facts := karma.Describe("template", spec.Template).
+		Describe("expr", spec.Expr)
+
+	regex, err := regexp.Compile(spec.Expr)
+	if err != nil {
+		return macro, facts.Format(err, "unable to compile macros regexp")
+	}
+
+	macro.Regexp = regex
+	macro.Config = spec.Config
+
+	tmpl, err := LoadTemplateRef(spec.Template, spec.Config, base, includePath, templates)
+	if err != nil {
+		return macro, facts.Format(err, "unable to load template")
+	}
+
+	macro.Template = tmpl
+
+	return macro, nil
+}
+
+// LoadTemplateRef resolves a single template reference: either "#field",
+// which pulls an inline template body out of config (a raw YAML document),
+// or a file path loaded via includes.LoadTemplate.
+func LoadTemplateRef(
+	ref string,
+	config string,
+	base string,
+	includePath string,
+	templates *template.Template,
+) (*template.Template, error) {
+	if strings.HasPrefix(ref, "#") {
+		cfg := map[string]interface{}{}
+
+		err := yaml.Unmarshal([]byte(config), &cfg)
+		if err != nil {
+			return nil, karma.Format(
+				err,
+				"unable to unmarshal macros config template",
+			)
+		}
+
+		body, ok := cfg[ref[1:]].(string)
+		if !ok {
+			return nil, fmt.Errorf(
+				"the template config doesn't have '%s' field",
+				ref[1:],
+			)
+		}
+
+		tmpl, err := templates.New(ref).Parse(body)
+		if err != nil {
+			return nil, karma.Format(err, "unable to parse template")
+		}
+
+		return tmpl, nil
+	}
+
+	tmpl, err := includes.LoadTemplate(base, includePath, ref, "{{", "}}", templates)
+	if err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
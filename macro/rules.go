@@ -0,0 +1,104 @@
+package macro
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Rule is one template alternative of a Macro. When the Macro's regexp
+// matches, every Rule whose selector (When) matches the match's tags is
+// executed, and their outputs are concatenated in declaration order. A
+// Macro parsed from the classic single-template directive form is
+// represented as a single Rule with a nil (always-matching) selector.
+type Rule struct {
+	When     map[string]interface{}
+	Template *template.Template
+}
+
+// ruleSpec is the YAML shape of one entry of a `rules:` list, e.g.:
+//
+//	rules:
+//	  - when: {lang: go}
+//	    template: code-go.tmpl
+//	  - when: {lang: any}
+//	    template: code-generic.tmpl
+type ruleSpec struct {
+	When     map[string]interface{} `yaml:"when"`
+	Template string                 `yaml:"template"`
+}
+
+// rulesSpec is the YAML shape of a macro directive's config when
+// `Template: rules` selects the multi-template form.
+type rulesSpec struct {
+	Rules []ruleSpec `yaml:"rules"`
+}
+
+// selectorMatches reports whether a rule's `when` selector matches tags, a
+// map built from the macro's named capture groups and the document's
+// front-matter. A nil/empty selector always matches. Supported value forms
+// per key: a literal string (equality), "any" (present or not, always
+// matches), "present"/"absent" (presence check ignoring value), and a
+// "!value" prefix (negated equality).
+func selectorMatches(when map[string]interface{}, tags map[string]string) bool {
+	for key, want := range when {
+		value, ok := tags[key]
+
+		switch want := want.(type) {
+		case string:
+			switch want {
+			case "any":
+				continue
+			case "present":
+				if !ok || value == "" {
+					return false
+				}
+			case "absent":
+				if ok && value != "" {
+					return false
+				}
+			default:
+				if strings.HasPrefix(want, "!") {
+					if value == strings.TrimPrefix(want, "!") {
+						return false
+					}
+				} else if value != want {
+					return false
+				}
+			}
+		case bool:
+			if want != (ok && value != "") {
+				return false
+			}
+		default:
+			if fmt.Sprint(want) != value {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// buildTags assembles the tag map that rule selectors match against: the
+// macro's named capture groups, overlaid on top of the document's
+// front-matter/vars (so a capture group wins over a same-named front-matter
+// tag).
+func buildTags(re *regexp.Regexp, groups [][]byte, vars map[string]string) map[string]string {
+	tags := make(map[string]string, len(vars))
+
+	for name, value := range vars {
+		tags[name] = value
+	}
+
+	for i, name := range re.SubexpNames() {
+		if name == "" || i >= len(groups) {
+			continue
+		}
+
+		tags[name] = string(groups[i])
+	}
+
+	return tags
+}
@@ -0,0 +1,106 @@
+package macro
+
+import "testing"
+
+func TestSelectorMatches(t *testing.T) {
+	tests := []struct {
+		name string
+		when map[string]interface{}
+		tags map[string]string
+		want bool
+	}{
+		{
+			name: "nil selector always matches",
+			when: nil,
+			tags: map[string]string{"lang": "go"},
+			want: true,
+		},
+		{
+			name: "equality match",
+			when: map[string]interface{}{"lang": "go"},
+			tags: map[string]string{"lang": "go"},
+			want: true,
+		},
+		{
+			name: "equality mismatch",
+			when: map[string]interface{}{"lang": "go"},
+			tags: map[string]string{"lang": "python"},
+			want: false,
+		},
+		{
+			name: "any always matches",
+			when: map[string]interface{}{"lang": "any"},
+			tags: map[string]string{},
+			want: true,
+		},
+		{
+			name: "present with value",
+			when: map[string]interface{}{"lang": "present"},
+			tags: map[string]string{"lang": "go"},
+			want: true,
+		},
+		{
+			name: "present without key fails",
+			when: map[string]interface{}{"lang": "present"},
+			tags: map[string]string{},
+			want: false,
+		},
+		{
+			name: "absent with missing key",
+			when: map[string]interface{}{"lang": "absent"},
+			tags: map[string]string{},
+			want: true,
+		},
+		{
+			name: "absent with present key fails",
+			when: map[string]interface{}{"lang": "absent"},
+			tags: map[string]string{"lang": "go"},
+			want: false,
+		},
+		{
+			name: "negation matches when value differs",
+			when: map[string]interface{}{"lang": "!go"},
+			tags: map[string]string{"lang": "python"},
+			want: true,
+		},
+		{
+			name: "negation fails when value equals",
+			when: map[string]interface{}{"lang": "!go"},
+			tags: map[string]string{"lang": "go"},
+			want: false,
+		},
+		{
+			name: "bool true requires present",
+			when: map[string]interface{}{"draft": true},
+			tags: map[string]string{"draft": "yes"},
+			want: true,
+		},
+		{
+			name: "bool false requires absent",
+			when: map[string]interface{}{"draft": false},
+			tags: map[string]string{},
+			want: true,
+		},
+		{
+			name: "bool true fails when absent",
+			when: map[string]interface{}{"draft": true},
+			tags: map[string]string{},
+			want: false,
+		},
+		{
+			name: "multiple keys all must match",
+			when: map[string]interface{}{"lang": "go", "draft": false},
+			tags: map[string]string{"lang": "go"},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectorMatches(tt.when, tt.tags)
+			if got != tt.want {
+				t.Errorf("selectorMatches(%v, %v) = %v, want %v", tt.when, tt.tags, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package macro
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// reVarRef finds the variable name referenced by a ${...} expression,
+// regardless of which bash-style operator (if any) follows it.
+var reVarRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)`)
+
+// buildEnv assembles the environment used for variable interpolation in
+// macro configs: OS environment variables overridden by the page's
+// front-matter variables and the `vars:` section of `.mark` / per-page
+// config, in that order of precedence.
+func buildEnv(vars map[string]string) map[string]string {
+	env := map[string]string{}
+
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	for name, value := range vars {
+		env[name] = value
+	}
+
+	return env
+}
+
+// interpolateVars expands bash-style variable references in s: ${VAR},
+// ${VAR:-default}, ${VAR:=default}, ${VAR##prefix}, ${VAR%%suffix} and
+// ${VAR/old/new}. Variable names are substituted longest-first so that,
+// e.g., ${BASE_URL} isn't partially matched by a shorter ${BASE}.
+func interpolateVars(s string, env map[string]string) string {
+	seen := map[string]bool{}
+
+	var names []string
+
+	for _, match := range reVarRef.FindAllStringSubmatch(s, -1) {
+		name := match[1]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+
+	for _, name := range names {
+		s = substituteVar(s, name, env)
+	}
+
+	return s
+}
+
+// substituteVar replaces every ${name...} reference in s, applying the
+// bash-style operator that follows the name, if any.
+func substituteVar(s string, name string, env map[string]string) string {
+	re := regexp.MustCompile(
+		`\$\{` + regexp.QuoteMeta(name) + `(?:(:-|:=|##|%%|/)([^}]*))?\}`,
+	)
+
+	return re.ReplaceAllStringFunc(s, func(expr string) string {
+		groups := re.FindStringSubmatch(expr)
+
+		var (
+			op    = groups[1]
+			arg   = groups[2]
+			value = env[name]
+		)
+
+		switch op {
+		case ":-":
+			if value == "" {
+				return arg
+			}
+
+			return value
+		case ":=":
+			if value == "" {
+				env[name] = arg
+				return arg
+			}
+
+			return value
+		case "##":
+			return strings.TrimPrefix(value, arg)
+		case "%%":
+			return strings.TrimSuffix(value, arg)
+		case "/":
+			parts := strings.SplitN(arg, "/", 2)
+
+			old := parts[0]
+
+			var replacement string
+			if len(parts) > 1 {
+				replacement = parts[1]
+			}
+
+			return strings.Replace(value, old, replacement, 1)
+		default:
+			return value
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package macro
+
+import "testing"
+
+func TestInterpolateVars(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		env  map[string]string
+		want string
+	}{
+		{
+			name: "plain reference",
+			s:    "hello ${NAME}",
+			env:  map[string]string{"NAME": "world"},
+			want: "hello world",
+		},
+		{
+			name: "unset reference expands to empty",
+			s:    "[${MISSING}]",
+			env:  map[string]string{},
+			want: "[]",
+		},
+		{
+			name: "default used when unset",
+			s:    "${COLOR:-blue}",
+			env:  map[string]string{},
+			want: "blue",
+		},
+		{
+			name: "default not used when set",
+			s:    "${COLOR:-blue}",
+			env:  map[string]string{"COLOR": "red"},
+			want: "red",
+		},
+		{
+			name: "assign-default sets env and expands",
+			s:    "${COLOR:=blue}-${COLOR}",
+			env:  map[string]string{},
+			want: "blue-blue",
+		},
+		{
+			name: "strip prefix",
+			s:    "${PATH##/usr/}",
+			env:  map[string]string{"PATH": "/usr/local/bin"},
+			want: "local/bin",
+		},
+		{
+			name: "strip suffix",
+			s:    "${FILE%%.txt}",
+			env:  map[string]string{"FILE": "report.txt"},
+			want: "report",
+		},
+		{
+			name: "search and replace",
+			s:    "${MSG/world/there}",
+			env:  map[string]string{"MSG": "hello world"},
+			want: "hello there",
+		},
+		{
+			name: "search and replace only replaces the first occurrence",
+			s:    "${MSG/a/b}",
+			env:  map[string]string{"MSG": "banana"},
+			want: "bbnana",
+		},
+		{
+			name: "longer name not partially matched by shorter name",
+			s:    "${BASE_URL}",
+			env:  map[string]string{"BASE": "wrong", "BASE_URL": "right"},
+			want: "right",
+		},
+		{
+			name: "does not expand capture-group placeholders",
+			s:    "${1} stays literal",
+			env:  map[string]string{"1": "should-not-appear"},
+			want: "${1} stays literal",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := interpolateVars(tt.s, tt.env)
+			if got != tt.want {
+				t.Errorf("interpolateVars(%q) = %q, want %q", tt.s, got, tt.want)
+			}
+		})
+	}
+}